@@ -21,14 +21,18 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"sync"
+	"syscall"
 	"time"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
@@ -39,12 +43,32 @@ const swVer = "1.0"
 
 var verbose bool = false
 
-// rectifier plugins structure
-type rectifier struct {
-	req, res []byte
-	sendback bool
-	desc     string
-}
+// TLS configuration, populated from the -local-tls*/-remote-tls* flags in
+// main(). localTLSConfig is also reused to terminate client StartTLS
+// requests when -starttls-terminate is set.
+var (
+	localTLSConfig    *tls.Config
+	remoteTLSConfig   *tls.Config
+	starttlsTerminate bool
+)
+
+// slowOpThreshold gates the full BER hex dump logged for a slow
+// operation; zero (the default) disables it
+var slowOpThreshold time.Duration
+
+// Connection timeouts and message size cap, populated from
+// -read-timeout/-write-timeout/-idle-timeout/-max-message-size; zero
+// disables the corresponding check
+var (
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	idleTimeout    time.Duration
+	maxMessageSize int
+)
+
+// activeConns tracks in-flight handleRequest/handleRoutedConn goroutines
+// so main() can wait for them to drain during graceful shutdown
+var activeConns sync.WaitGroup
 
 func logVerboseln(v ...interface{}) {
 	if verbose {
@@ -58,6 +82,20 @@ func logVerbosef(format string, v ...interface{}) {
 	}
 }
 
+// logPanicRecovery records and logs a panic recover()ed from a
+// connection-handling goroutine, so a malformed/malicious packet takes
+// down only that connection instead of the whole process. Callers must
+// still call recover() themselves, directly inside their own deferred
+// function, since recover only stops a panic when invoked that way.
+func logPanicRecovery(r interface{}) {
+	metricsErrors.WithLabelValues("panic").Inc()
+	logVerboseln("Recovering from panic:", r)
+	logVerboseln("Stack Trace:")
+	if verbose {
+		debug.PrintStack()
+	}
+}
+
 func main() {
 
 	// Command line options
@@ -65,6 +103,24 @@ func main() {
 	remoteAddr := flag.String("remote", ":4000", "remote address")
 	verboseFlag := flag.Bool("verbose", false, "Print additional information")
 	showSwVer := flag.Bool("version", false, "Print software version and exit")
+	localTLSFlag := flag.Bool("local-tls", false, "Accept LDAPS (TLS) connections on the local listener")
+	localTLSCert := flag.String("local-tls-cert", "", "Server certificate (PEM) for -local-tls and -starttls-terminate")
+	localTLSKey := flag.String("local-tls-key", "", "Server private key (PEM) for -local-tls and -starttls-terminate")
+	remoteTLSFlag := flag.Bool("remote-tls", false, "Connect to the upstream server using LDAPS (TLS)")
+	remoteTLSCA := flag.String("remote-tls-ca", "", "CA certificate (PEM) used to verify the upstream server")
+	remoteTLSInsecure := flag.Bool("remote-tls-insecure", false, "Skip upstream certificate verification (insecure)")
+	starttlsTerminateFlag := flag.Bool("starttls-terminate", false, "Terminate client StartTLS requests locally instead of forwarding them upstream")
+	configFile := flag.String("config", "", "Path to the YAML/JSON rule config file (see Rule in rules.go); no rules run if unset")
+	routerConfigFile := flag.String("router-config", "", "Path to a YAML/JSON router config (see RouterConfig in router.go); overrides -remote with multi-backend routing")
+	routerIdleTimeout := flag.Duration("router-idle-timeout", 60*time.Second, "How long an idle pooled backend connection is kept before being closed")
+	ntlmUsersFile := flag.String("ntlm-users-file", "", "Path to a YAML username: password map used to verify NTLM SASL binds terminated by the proxy")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus /metrics on (disabled if unset)")
+	slowOpThresholdFlag := flag.Duration("slow-op-threshold", 0, "Log a full BER hex dump for operations slower than this, regardless of -verbose (disabled if 0)")
+	readTimeoutFlag := flag.Duration("read-timeout", 0, "Deadline for reading the body of an in-progress LDAP message once it has started arriving (disabled if 0)")
+	writeTimeoutFlag := flag.Duration("write-timeout", 0, "Deadline for writing a (possibly rectified) LDAP message back out (disabled if 0)")
+	idleTimeoutFlag := flag.Duration("idle-timeout", 0, "Deadline for a connection to send the start of its next LDAP message before it's considered idle and closed (disabled if 0)")
+	maxMessageSizeFlag := flag.Int("max-message-size", 0, "Reject LDAP messages whose advertised BER length exceeds this many bytes, before allocating for them (disabled if 0)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "Bounded drain period for in-flight connections on SIGTERM/SIGINT before forcing exit")
 	flag.Parse()
 
 	// Show Software version
@@ -76,12 +132,85 @@ func main() {
 
 	// Assign globally
 	verbose = *verboseFlag
+	starttlsTerminate = *starttlsTerminateFlag
+	slowOpThreshold = *slowOpThresholdFlag
+	readTimeout = *readTimeoutFlag
+	writeTimeout = *writeTimeoutFlag
+	idleTimeout = *idleTimeoutFlag
+	maxMessageSize = *maxMessageSizeFlag
 
 	log.Printf("Starting ldap-proxy: lighweght proxy for LDAP\n")
 	log.Printf("Version: %s\n", swVer)
 
+	// Local TLS config: needed both for -local-tls and for terminating
+	// StartTLS on an otherwise plaintext listener
+	if *localTLSFlag || starttlsTerminate {
+		if *localTLSCert == "" || *localTLSKey == "" {
+			log.Fatal("-local-tls-cert and -local-tls-key are required for -local-tls or -starttls-terminate")
+		}
+		cfg, err := loadServerTLSConfig(*localTLSCert, *localTLSKey)
+		if err != nil {
+			log.Fatal("Unable to load local TLS configuration: ", err)
+		}
+		localTLSConfig = cfg
+	}
+
+	// Remote TLS config, used when dialing the upstream LDAP server
+	if *remoteTLSFlag {
+		cfg, err := loadClientTLSConfig(*remoteTLSCA, *remoteTLSInsecure)
+		if err != nil {
+			log.Fatal("Unable to load remote TLS configuration: ", err)
+		}
+		remoteTLSConfig = cfg
+	}
+
+	// Rectifier rules, loaded once at startup
+	if *configFile != "" {
+		rs, err := loadRules(*configFile)
+		if err != nil {
+			log.Fatal("Unable to load rule config: ", err)
+		}
+		rules = rs
+		log.Printf("Loaded %d rectifier rule(s) from %s\n", len(rules), *configFile)
+	}
+
+	// Multi-backend router, loaded once at startup; when set it replaces
+	// the single -remote upstream entirely
+	if *routerConfigFile != "" {
+		cfg, err := loadRouterConfig(*routerConfigFile)
+		if err != nil {
+			log.Fatal("Unable to load router config: ", err)
+		}
+		router = cfg
+		startPoolJanitor(*routerIdleTimeout)
+		log.Printf("Loaded router config from %s: %d backend(s), %d route(s)\n", *routerConfigFile, len(router.Backends), len(router.Routes))
+	}
+
+	// NTLM credential table, used to verify SASL/NTLM binds terminated by
+	// the proxy itself
+	if *ntlmUsersFile != "" {
+		users, err := loadNTLMUsers(*ntlmUsersFile)
+		if err != nil {
+			log.Fatal("Unable to load NTLM users file: ", err)
+		}
+		ntlmUsers = users
+		log.Printf("Loaded %d NTLM user(s) from %s\n", len(ntlmUsers), *ntlmUsersFile)
+	}
+
+	// Prometheus metrics endpoint
+	if *metricsAddr != "" {
+		startMetricsServer(*metricsAddr)
+		log.Println("Serving metrics on: ", *metricsAddr)
+	}
+
 	// Listen for connections
-	ln, err := net.Listen("tcp", *localAddr)
+	var ln net.Listener
+	var err error
+	if *localTLSFlag {
+		ln, err = tls.Listen("tcp", *localAddr, localTLSConfig)
+	} else {
+		ln, err = net.Listen("tcp", *localAddr)
+	}
 	if err != nil {
 		log.Fatal("Unable to create listener:", err)
 	}
@@ -89,16 +218,53 @@ func main() {
 	log.Println("Listening from: ", *localAddr)
 	log.Println("Sending to: ", *remoteAddr)
 
+	// Graceful shutdown: on SIGTERM/SIGINT stop accepting new connections
+	// and give in-flight handleRequest/handleRoutedConn goroutines a
+	// bounded drain period before exiting
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		log.Println("Received signal, shutting down:", sig)
+		ln.Close()
+
+		drained := make(chan struct{})
+		go func() {
+			activeConns.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+			log.Println("All connections drained")
+		case <-time.After(*shutdownTimeout):
+			log.Println("Shutdown timeout reached, exiting with connections still in flight")
+		}
+		os.Exit(0)
+	}()
+
 	// Accept new incoming connections
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("Listener closed, stopping accept loop")
+				return
+			}
 			log.Println(err)
 			continue
 		}
 
 		// Start a new thread to handle the new incoming connection
-		go handleConn(conn, *remoteAddr)
+		metricsConnsAccepted.Inc()
+		if router != nil {
+			activeConns.Add(1)
+			go func() {
+				defer activeConns.Done()
+				handleRoutedConn(conn, router)
+			}()
+		} else {
+			go handleConn(conn, *remoteAddr)
+		}
 	}
 }
 
@@ -109,10 +275,16 @@ func handleConn(conn net.Conn, remoteAddr string) {
 	log.Println("New connection from: ", conn.RemoteAddr())
 
 	// Connect to remote server to proxy data to
-	rconn, err := net.Dial("tcp", remoteAddr)
+	var rconn net.Conn
+	var err error
+	if remoteTLSConfig != nil {
+		rconn, err = tls.Dial("tcp", remoteAddr, remoteTLSConfig)
+	} else {
+		rconn, err = net.Dial("tcp", remoteAddr)
+	}
 	if err != nil {
 		log.Println("Error dialing", err)
-		rconn.Close()
+		conn.Close()
 		return
 	}
 	log.Println("Server connection to: ", rconn.RemoteAddr())
@@ -121,55 +293,80 @@ func handleConn(conn net.Conn, remoteAddr string) {
 	// we need 2 async threads otherwise an incomplete request/response
 	// may block the communication flow from the OSI L7 perspective
 	// because of infinite waiting for data from one of the counterparts
-	go handleRequest(conn, rconn, "client to proxy", true)  // client to proxy
-	go handleRequest(rconn, conn, "server to proxy", false) // server to proxy
+	// Both directions run through the rectifier: request-side rules can
+	// forward/rewrite/synthesize/deny, response-side rules (eg.
+	// searchResEntry) can only rewrite in place, since synthesizing or
+	// denying a response that already left the server makes no sense
+	//
+	// conn is wrapped in a sharedConn so that if the client-to-proxy
+	// goroutine upgrades it in place (StartTLS termination), the
+	// server-to-proxy goroutine writing responses back to the client
+	// sees the same upgraded connection rather than the stale plaintext
+	// one
+	sc := newSharedConn(conn)
+	activeConns.Add(2)
+	go handleRequest(sc, rconn, "client to proxy", true) // client to proxy
+	go handleRequest(rconn, sc, "server to proxy", true) // server to proxy
 }
 
 func handleRequest(conn net.Conn, rconn net.Conn, desc string, useRectifier bool) {
+	defer activeConns.Done()
 	defer func() {
 		if r := recover(); r != nil {
-			logVerboseln("Recovering from panic:", r)
-			logVerboseln("Stack Trace:")
-			if verbose {
-				debug.PrintStack()
-			}
+			logPanicRecovery(r)
 		}
 		log.Println("handleRequest: deferred connection closure: ", desc)
 		conn.Close()
 		rconn.Close()
+		ntlmForget(conn)
 	}()
 
 	// From source to proxy
 	buf := bufio.NewReader(conn)
+	metricsActiveSessions.Inc()
+	defer metricsActiveSessions.Dec()
 
 	// Loop while communication channel is alive
 	for {
+		// Wait for the next message to start arriving; if nothing shows up
+		// within idleTimeout the connection is considered idle and closed
+		if idleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(idleTimeout))
+			if _, err := buf.Peek(1); err != nil {
+				log.Println("Error read (idle):", err)
+				return
+			}
+		}
+
+		// Reject an oversized message before ber.ReadPacket allocates
+		// anything for it, by peeking its BER length header first
+		if maxMessageSize > 0 {
+			size, err := peekBERLength(buf)
+			if errors.Is(err, errUnsupportedBERLength) {
+				log.Printf("Rejecting unparseable LDAP message length header: %v: %s\n", err, desc)
+				return
+			}
+			if err == nil && size > maxMessageSize {
+				log.Printf("Rejecting oversized LDAP message: %d bytes (max %d): %s\n", size, maxMessageSize, desc)
+				return
+			}
+		}
+
 		// Read ASN.1 data from source
 		start := time.Now()
-		log.Println("   ber.PacketRead -> ", desc)
+		if readTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
 		packet, err := ber.ReadPacket(buf)
 		if err != nil {
 			log.Println("Error read:", err)
 			return
 		}
-		t := time.Now()
-		elapsed := t.Sub(start)
-		logVerboseln("   Duration ber.PacketRead -> ", desc, elapsed)
-
-		// Calculate total lenght
-		packetLen := len(packet.Bytes())
-		log.Printf("Received %d bytes: %s\n", packetLen, desc)
-		logVerbosef("%s", hex.Dump(packet.Bytes()[:packetLen]))
-
-		// Calculate lenght of the ASN.1 packet data without headers
-		dataLen := packet.Data.Len()
-		packetDataOffset := packetLen - dataLen
-		logVerbosef("LEN-Data: %d\n", dataLen)
-		logVerbosef("%s", hex.Dump(packet.Bytes()[packetDataOffset:packetLen]))
+		bytesIn := len(packet.Bytes())
+		metricsBytes.WithLabelValues(desc, "in").Add(float64(bytesIn))
 
 		// Sanity checks on the packet's children
 		childrenLen := len(packet.Children)
-		logVerbosef("LEN-Children: %d\n", childrenLen)
 		if childrenLen == 0 {
 			log.Println("Invalid packet: no children found")
 			continue
@@ -178,22 +375,73 @@ func handleRequest(conn net.Conn, rconn net.Conn, desc string, useRectifier bool
 			log.Println("Unrecognized messageID", packet.Children[0].Value)
 			continue
 		}
-
-		// Calculate lenght of the remaining ASN.1 packet without headers and LDAP messageID
-		dataMessageIDLen := len(packet.Children[0].Bytes())
-		packetDataNoMsgIDOffset := packetDataOffset + dataMessageIDLen
 		messageID := packet.Children[0].Value.(int64)
-		logVerbosef("messageID: %d\n", messageID)
-		logVerbosef("LEN-messageID: %d\n", dataMessageIDLen)
-		logVerbosef("%s", hex.Dump(packet.Bytes()[packetDataNoMsgIDOffset:packetLen]))
+		opName := "unknown"
+		if childrenLen > 1 {
+			if n, ok := opNames[packet.Children[1].Tag]; ok {
+				opName = n
+			}
+		}
+		metricsOps.WithLabelValues(opName).Inc()
+
+		// Intercept StartTLS: if termination is enabled and the client is
+		// asking for it, answer with a synthetic success ExtendedResponse
+		// and upgrade the client-side connection instead of forwarding
+		// the request upstream
+		if useRectifier && starttlsTerminate && childrenLen > 1 && isStartTLSRequest(packet.Children[1]) {
+			sc, ok := conn.(*sharedConn)
+			if !ok {
+				log.Println("StartTLS requested on a connection that doesn't support in-place upgrade:", desc)
+				return
+			}
+			log.Println("StartTLS requested by client, terminating locally: ", desc)
+			if err := terminateStartTLS(sc, messageID); err != nil {
+				log.Println("Error terminating StartTLS:", err)
+				return
+			}
+			buf = bufio.NewReader(conn)
+			continue
+		}
+
+		// Intercept SASL/NTLM binds: the proxy terminates the NTLM
+		// handshake itself (see ntlm.go) and answers the client directly.
+		// GSS-SPNEGO is recognized but not unwrapped, so it falls through
+		// to the normal forward/rectify path below.
+		if useRectifier && childrenLen > 1 && packet.Children[1].Tag == tagBindRequest {
+			if mech, creds, ok := saslBindAuth(packet.Children[1]); ok {
+				switch mech {
+				case ntlmMechanism:
+					log.Println("NTLM SASL bind requested: ", desc)
+					if err := handleNTLMBind(conn, messageID, creds); err != nil {
+						log.Println("Error handling NTLM bind:", err)
+						return
+					}
+					continue
+				case gssSpnegoMechanism:
+					log.Println("GSS-SPNEGO SASL bind requested (SPNEGO unwrapping not implemented, forwarding unchanged): ", desc)
+				}
+			}
+		}
 
 		// Prepare outgoing data
 		out := make([]byte, 0)
 		rectified := false
 		sendback := false
 		if useRectifier {
-			// use rectifier function to rectify data
-			log.Println("Rectifier enabled: processing")
+			// searchRequest synthesis needs more than one LDAP message
+			// (SearchResultEntry per configured entry, then
+			// SearchResultDone), so it can't be expressed as extra
+			// children of a single response envelope like the other
+			// actions below: handle it directly and move on
+			if childrenLen > 1 {
+				if rule, ok := matchSearchSynthesize(packet.Children[1]); ok {
+					if err := sendSynthesizedSearchResult(conn, messageID, rule); err != nil {
+						log.Println("Error sending synthesized search result:", err)
+						return
+					}
+					continue
+				}
+			}
 
 			// Create ASN.1 LDAP header (SEQUENCE + messageID)
 			// This is necessary to envelope the date after processing
@@ -201,30 +449,31 @@ func handleRequest(conn net.Conn, rconn net.Conn, desc string, useRectifier bool
 			rectifiedPacket.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "messageID"))
 
 			// Rectify data for *all* children
-			for i, child := range packet.Children[1:] {
-				d, r, s := rectifyData(child.Bytes())
+			for _, child := range packet.Children[1:] {
+				d, r, s := rectifyData(child)
 				// Check if data has been actually rectified
 				rectified = rectified || r
 				// Check if data need to be sentback and NOT forwarded to destination
 				sendback = sendback || s
-				log.Printf("Rectifier [%d]: rectified: %t sendback: %t", i, rectified, sendback)
-				rectifiedPacket.AppendChild(ber.DecodePacket(d))
+				rectifiedPacket.AppendChild(d)
 			}
 
 			out = append(out, rectifiedPacket.Bytes()[:]...)
 		} else {
 			// Copy data
-			log.Println("Rectifier disabled: copying")
 			out = append(out, packet.Bytes()[:]...)
 		}
 
 		// Write data to destination
-		start = time.Now()
 		if rectified && sendback {
-			log.Println("   rconn.Write (sendback) -> ", desc)
+			if writeTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
 			_, err = conn.Write(out)
 		} else {
-			log.Println("   rconn.Write -> ", desc)
+			if writeTimeout > 0 {
+				rconn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
 			_, err = rconn.Write(out)
 		}
 
@@ -232,50 +481,14 @@ func handleRequest(conn net.Conn, rconn net.Conn, desc string, useRectifier bool
 			log.Println("Error write:", err)
 			return
 		}
-		t = time.Now()
-		elapsed = t.Sub(start)
-		logVerboseln("   Duration rconn.Write -> ", desc, elapsed)
-	}
-}
+		metricsBytes.WithLabelValues(desc, "out").Add(float64(len(out)))
 
-func rectifyData(b []byte) ([]byte, bool, bool) {
-	logVerboseln("rectifyData: entering")
-
-	rectified := false
-	sendback := false
-	rectifiers := initRectifiers()
-	for _, singleRectifier := range rectifiers[:] {
-		if bytes.Contains(b, singleRectifier.req) {
-			b = singleRectifier.res
-			rectified = rectified || true
-			sendback = sendback || singleRectifier.sendback
-			logVerbosef("rectifyData [%s]: rectified\n", singleRectifier.desc)
-		} else {
-			rectified = rectified || false
-			sendback = sendback || false
-			logVerbosef("rectifyData [%s]: NOT rectified\n", singleRectifier.desc)
+		duration := time.Since(start)
+		metricsOpDuration.WithLabelValues(opName).Observe(duration.Seconds())
+		logLDAPEvent(desc, messageID, opName, packet, duration, bytesIn, len(out), rectified, sendback)
+		if slowOpThreshold > 0 && duration >= slowOpThreshold {
+			log.Printf("SLOW OP: %s msgID=%d op=%s duration=%s\n%s", desc, messageID, opName, duration, hex.Dump(packet.Bytes()))
 		}
 	}
-	return b, rectified, sendback
 }
 
-// Initialize all rectifiers
-func initRectifiers() []rectifier {
-	r := make([]rectifier, 0)
-
-	// Rectifier prova
-	r = append(r, rectifier{
-		req: []byte{
-			0x63, 0x33, 0x04, 0x00, 0x0a, 0x01, 0x00, 0x0a, 0x01, 0x03, 0x02, 0x01, 0x00, 0x02, 0x01, 0x00, /* c3.............. */
-			0x01, 0x01, 0x00, 0x87, 0x0b, 0x6f, 0x62, 0x6a, 0x65, 0x63, 0x74, 0x43, 0x6c, 0x61, 0x73, 0x73, /* .....objectClass */
-			0x30, 0x13, 0x04, 0x11, 0x73, 0x75, 0x62, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, 0x53, 0x75, 0x62, /* 0...subschemaSub */
-			0x65, 0x6e, 0x74, 0x72, 0x79,
-		},
-		res: []byte{
-			0x64, 0x26, 0x04, 0x00, 0x30, 0x22, 0x30, 0x20, 0x04, 0x11, 0x73, 0x75, 0x62, 0x73, 0x63, 0x68, /* d&..0"0 ..subsch */
-			0x65, 0x6d, 0x61, 0x53, 0x75, 0x62, 0x65, 0x6e, 0x74, 0x72, 0x79, 0x31, 0x0b, 0x04, 0x09, 0x63, /* emaSubentry1...c */
-			0x6e, 0x3d, 0x73, 0x63, 0x68, 0x65, 0x6d, 0x61, /* n=schema */
-		},
-		sendback: true, desc: "prova"})
-	return r
-}
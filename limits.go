@@ -0,0 +1,50 @@
+// limits.go: bounds on how long the proxy will wait for data and how
+// large an advertised LDAP message it will allocate for, so a malicious or
+// slow client can't hang a goroutine forever or OOM the process.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+)
+
+// errUnsupportedBERLength is returned by peekBERLength when the length
+// octets it read are well-formed but describe an encoding (5+ length
+// octets, or the indefinite form) this proxy doesn't support. Unlike a
+// plain buf.Peek I/O error (short read, timeout), it means the message
+// itself, however large, can never be sized — so callers enforcing
+// -max-message-size should treat it as a rejection, not just fall
+// through to ber.ReadPacket under the read/idle deadline as usual.
+var errUnsupportedBERLength = errors.New("unsupported BER length encoding")
+
+// peekBERLength inspects the BER header at the front of buf without
+// consuming it, returning the total on-wire size of the next packet
+// (header + content), so callers can reject an oversized message before
+// ber.ReadPacket allocates anything for it. LDAP messages are always a
+// top-level SEQUENCE, so the tag itself is always a single byte; this
+// only needs to handle the length octets (ITU-T X.690 section 8.1.3).
+func peekBERLength(buf *bufio.Reader) (int, error) {
+	head, err := buf.Peek(2)
+	if err != nil {
+		return 0, err
+	}
+	if head[1] < 0x80 {
+		return 2 + int(head[1]), nil
+	}
+
+	numLenBytes := int(head[1] & 0x7f)
+	if numLenBytes == 0 || numLenBytes > 4 {
+		return 0, fmt.Errorf("%w (%d length octets)", errUnsupportedBERLength, numLenBytes)
+	}
+	lenBytes, err := buf.Peek(2 + numLenBytes)
+	if err != nil {
+		return 0, err
+	}
+	length := 0
+	for _, b := range lenBytes[2:] {
+		length = length<<8 | int(b)
+	}
+	return 2 + numLenBytes + length, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPeekBERLengthShortForm(t *testing.T) {
+	// SEQUENCE, length 5 (short form), plus trailing content so Peek(2)
+	// succeeds without needing the body
+	buf := bufio.NewReader(bytes.NewReader([]byte{0x30, 0x05, 0, 0, 0, 0, 0}))
+	size, err := peekBERLength(buf)
+	if err != nil {
+		t.Fatalf("peekBERLength: %v", err)
+	}
+	if size != 7 {
+		t.Fatalf("size = %d, want 7", size)
+	}
+}
+
+func TestPeekBERLengthLongForm(t *testing.T) {
+	// SEQUENCE, length encoded in 2 octets: 0x0100 = 256
+	data := []byte{0x30, 0x82, 0x01, 0x00}
+	data = append(data, make([]byte, 256)...)
+	buf := bufio.NewReader(bytes.NewReader(data))
+	size, err := peekBERLength(buf)
+	if err != nil {
+		t.Fatalf("peekBERLength: %v", err)
+	}
+	if want := 4 + 256; size != want {
+		t.Fatalf("size = %d, want %d", size, want)
+	}
+}
+
+func TestPeekBERLengthUnsupportedEncoding(t *testing.T) {
+	// 0x85 -> 5 length octets, more than peekBERLength supports. Callers
+	// enforcing -max-message-size must be able to tell this apart from a
+	// plain short/truncated read (below), since there's no size to
+	// eventually recover by reading more.
+	buf := bufio.NewReader(bytes.NewReader([]byte{0x30, 0x85, 0, 0, 0, 0, 0}))
+	_, err := peekBERLength(buf)
+	if err == nil {
+		t.Fatal("expected an error for a 5-octet length encoding")
+	}
+	if !errors.Is(err, errUnsupportedBERLength) {
+		t.Errorf("expected errUnsupportedBERLength, got %v", err)
+	}
+}
+
+func TestPeekBERLengthTruncated(t *testing.T) {
+	buf := bufio.NewReader(bytes.NewReader([]byte{0x30}))
+	_, err := peekBERLength(buf)
+	if err == nil {
+		t.Fatal("expected an error when the header is truncated")
+	}
+	if errors.Is(err, errUnsupportedBERLength) {
+		t.Error("a truncated read is a plain I/O error, not an unsupported encoding")
+	}
+}
@@ -0,0 +1,88 @@
+// logging.go: structured, one-event-per-LDAP-message logging, replacing
+// the old line-per-step logVerbosef/log.Println chatter in handleRequest.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+var structuredLogger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+// logLDAPEvent emits one structured log line for the LDAP message just
+// processed by handleRequest.
+func logLDAPEvent(desc string, messageID int64, opName string, packet *ber.Packet, duration time.Duration, bytesIn, bytesOut int, rectified, sendback bool) {
+	attrs := []any{
+		slog.String("direction", desc),
+		slog.Int64("msgID", messageID),
+		slog.String("op", opName),
+		slog.Int("bytesIn", bytesIn),
+		slog.Int("bytesOut", bytesOut),
+		slog.Int64("durationMs", duration.Milliseconds()),
+		slog.Bool("rectified", rectified),
+		slog.Bool("sendback", sendback),
+	}
+
+	if len(packet.Children) > 1 {
+		op := packet.Children[1]
+		if baseDN, ok := opBaseDN(op); ok {
+			attrs = append(attrs, slog.String("baseDN", baseDN))
+		}
+		if filter, ok := opFilter(op); ok {
+			attrs = append(attrs, slog.String("filter", filter))
+		}
+		if resultCode, ok := opResultCode(op); ok {
+			attrs = append(attrs, slog.Int64("resultCode", resultCode))
+		}
+	}
+
+	structuredLogger.Info("ldap message", attrs...)
+}
+
+// opBaseDN best-effort extracts the baseDN/bindDN/objectName field carried
+// by op, for the ops where that's meaningful.
+func opBaseDN(op *ber.Packet) (string, bool) {
+	switch op.Tag {
+	case tagBindRequest:
+		if len(op.Children) > 1 {
+			return string(op.Children[1].Data.Bytes()), true
+		}
+	case tagSearchRequest, tagModifyRequest, tagSearchResEntry:
+		if len(op.Children) > 0 {
+			return string(op.Children[0].Data.Bytes()), true
+		}
+	}
+	return "", false
+}
+
+// opFilter decompiles a SearchRequest's filter to its string form.
+func opFilter(op *ber.Packet) (string, bool) {
+	if op.Tag != tagSearchRequest || len(op.Children) < 7 {
+		return "", false
+	}
+	filterStr, err := ldap.DecompileFilter(op.Children[6])
+	if err != nil {
+		return "", false
+	}
+	return filterStr, true
+}
+
+// opResultCode reads the resultCode out of any LDAPResult-shaped response
+// (BindResponse, SearchResultDone, ModifyResponse, ExtendedResponse, ...).
+func opResultCode(op *ber.Packet) (int64, bool) {
+	switch op.Tag {
+	case tagBindResponse, tagSearchResDone, tagModifyResponse, ber.Tag(tagExtendedResponse):
+	default:
+		return 0, false
+	}
+	if len(op.Children) == 0 {
+		return 0, false
+	}
+	rc, ok := op.Children[0].Value.(int64)
+	return rc, ok
+}
@@ -0,0 +1,54 @@
+// metrics.go: Prometheus instrumentation, served on -metrics-addr.
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsConnsAccepted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ldap_proxy_connections_accepted_total",
+		Help: "Total number of client connections accepted.",
+	})
+	metricsActiveSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ldap_proxy_active_sessions",
+		Help: "Number of handleRequest goroutines (client or server direction) currently running.",
+	})
+	metricsBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ldap_proxy_bytes_total",
+		Help: "Bytes proxied, by connection direction and in/out.",
+	}, []string{"direction", "way"})
+	metricsOps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ldap_proxy_operations_total",
+		Help: "LDAP messages seen, by operation type.",
+	}, []string{"op"})
+	metricsRectifierHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ldap_proxy_rectifier_hits_total",
+		Help: "Rectifier rule matches, by rule name and action.",
+	}, []string{"rule", "action"})
+	metricsOpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "ldap_proxy_operation_duration_seconds",
+		Help: "Time from reading an LDAP message to writing its (possibly rectified) output.",
+	}, []string{"op"})
+	metricsErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ldap_proxy_errors_total",
+		Help: "Errors and recovered panics, by kind.",
+	}, []string{"kind"})
+)
+
+// startMetricsServer serves /metrics on addr in the background.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatal("metrics server: ", err)
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"testing"
+)
+
+func TestNtowfv2Deterministic(t *testing.T) {
+	a := ntowfv2("alice", "hunter2")
+	b := ntowfv2("alice", "hunter2")
+	if string(a) != string(b) {
+		t.Fatal("ntowfv2 is not deterministic for the same username/password")
+	}
+	if len(a) != 16 {
+		t.Fatalf("ntowfv2 returned %d bytes, want 16 (HMAC-MD5)", len(a))
+	}
+}
+
+func TestNtowfv2UsernameCaseInsensitive(t *testing.T) {
+	lower := ntowfv2("alice", "hunter2")
+	upper := ntowfv2("ALICE", "hunter2")
+	if string(lower) != string(upper) {
+		t.Fatal("ntowfv2 must fold username case (MS-NLMP uses Upper(username))")
+	}
+}
+
+func TestNtowfv2PasswordSensitive(t *testing.T) {
+	a := ntowfv2("alice", "hunter2")
+	b := ntowfv2("alice", "wrongpass")
+	if string(a) == string(b) {
+		t.Fatal("ntowfv2 produced the same key for different passwords")
+	}
+}
+
+func TestVerifyNTLMv2ResponseRoundTrip(t *testing.T) {
+	serverChallenge := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	blob := []byte("client-provided-blob")
+
+	ntResponse := computeTestNTLMv2Response(t, "alice", "hunter2", serverChallenge, blob)
+
+	if !verifyNTLMv2Response("alice", "hunter2", serverChallenge, ntResponse) {
+		t.Fatal("verifyNTLMv2Response rejected a correctly computed response")
+	}
+	if verifyNTLMv2Response("alice", "wrongpass", serverChallenge, ntResponse) {
+		t.Fatal("verifyNTLMv2Response accepted a response for the wrong password")
+	}
+}
+
+func TestVerifyNTLMv2ResponseTooShort(t *testing.T) {
+	serverChallenge := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if verifyNTLMv2Response("alice", "hunter2", serverChallenge, make([]byte, 15)) {
+		t.Fatal("verifyNTLMv2Response accepted a response shorter than NTProofStr")
+	}
+}
+
+func TestParseNTLMAuthenticateMalformedOffset(t *testing.T) {
+	msg := make([]byte, 44)
+	copy(msg[0:8], "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:12], 3) // message type: authenticate
+
+	// ntResponse field descriptor at offset 20: length 9, offset 0xFFFFFFFF.
+	// offset+length overflows uint32 back into range, so the bounds check
+	// must widen to uint64 instead of wrapping around with it.
+	binary.LittleEndian.PutUint16(msg[20:22], 9)
+	binary.LittleEndian.PutUint32(msg[24:28], 0xFFFFFFFF)
+
+	if _, _, err := parseNTLMAuthenticate(msg); err == nil {
+		t.Fatal("parseNTLMAuthenticate accepted an out-of-range ntResponse offset instead of rejecting it")
+	}
+}
+
+// computeTestNTLMv2Response builds ntResponse the way a real NTLMv2 client
+// would, so the round-trip test exercises verifyNTLMv2Response against an
+// independently assembled message rather than against its own output.
+func computeTestNTLMv2Response(t *testing.T, username, password string, serverChallenge [8]byte, blob []byte) []byte {
+	t.Helper()
+	mac := hmac.New(md5.New, ntowfv2(username, password))
+	mac.Write(serverChallenge[:])
+	mac.Write(blob)
+	proof := mac.Sum(nil)
+	return append(proof, blob...)
+}
@@ -0,0 +1,773 @@
+// router.go: multi-backend routing. When a -router-config file is given,
+// ldap-proxy stops speaking to a single -remote address and instead picks
+// an upstream backend per LDAP message based on the bindDN (for
+// BindRequest) or baseDN (for SearchRequest/ModifyRequest), routing each
+// client session over one dedicated, pooled connection per backend it
+// touches. Client-chosen messageIDs are rewritten per upstream connection
+// and rewritten back on the way out, since the same pooled connection is
+// reused by different client sessions over time.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"gopkg.in/yaml.v3"
+)
+
+// router is the active routing config, or nil when routing is disabled
+// and the proxy runs in its original 1:1 -remote mode.
+var router *RouterConfig
+
+// backends and pools are built once from router at startup and never
+// mutated afterwards, so they need no locking of their own.
+var backends map[string]*Backend
+var pools map[string]*backendPool
+
+// BackendConfig describes one named upstream in the -router-config file.
+type BackendConfig struct {
+	Address      string        `yaml:"address" json:"address"`
+	TLS          bool          `yaml:"tls,omitempty" json:"tls,omitempty"`
+	TLSCA        string        `yaml:"tlsCA,omitempty" json:"tlsCA,omitempty"`
+	TLSInsecure  bool          `yaml:"tlsInsecure,omitempty" json:"tlsInsecure,omitempty"`
+	DialTimeout  time.Duration `yaml:"dialTimeout,omitempty" json:"dialTimeout,omitempty"`
+	ReadTimeout  time.Duration `yaml:"readTimeout,omitempty" json:"readTimeout,omitempty"`
+	WriteTimeout time.Duration `yaml:"writeTimeout,omitempty" json:"writeTimeout,omitempty"`
+}
+
+// RouteConfig maps one baseDN/bindDN pattern to a named backend. Routes
+// are evaluated in order; the first match wins.
+type RouteConfig struct {
+	Backend string `yaml:"backend" json:"backend"`
+	BaseDN  string `yaml:"baseDN,omitempty" json:"baseDN,omitempty"`
+	BindDN  string `yaml:"bindDN,omitempty" json:"bindDN,omitempty"`
+
+	baseDNRe *regexp.Regexp
+	bindDNRe *regexp.Regexp
+}
+
+// RouterConfig is the top-level -router-config document.
+type RouterConfig struct {
+	Backends map[string]BackendConfig `yaml:"backends" json:"backends"`
+	Routes   []RouteConfig            `yaml:"routes" json:"routes"`
+	Default  string                   `yaml:"default,omitempty" json:"default,omitempty"`
+}
+
+// Backend is a resolved, ready-to-dial upstream.
+type Backend struct {
+	Name         string
+	Address      string
+	TLSConfig    *tls.Config
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// loadRouterConfig reads, validates and resolves path into backends/pools,
+// compiling each route's regexes once up front.
+func loadRouterConfig(path string) (*RouterConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading router config: %w", err)
+	}
+
+	var cfg RouterConfig
+	if strings.HasSuffix(path, ".json") {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parsing JSON router config: %w", err)
+		}
+	} else {
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("parsing YAML router config: %w", err)
+		}
+	}
+
+	if cfg.Default != "" {
+		if _, ok := cfg.Backends[cfg.Default]; !ok {
+			return nil, fmt.Errorf("default backend %q is not defined", cfg.Default)
+		}
+	}
+
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
+		if _, ok := cfg.Backends[r.Backend]; !ok {
+			return nil, fmt.Errorf("route %d: backend %q is not defined", i, r.Backend)
+		}
+		if r.BaseDN != "" {
+			re, err := regexp.Compile(r.BaseDN)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: invalid baseDN regex: %w", i, err)
+			}
+			r.baseDNRe = re
+		}
+		if r.BindDN != "" {
+			re, err := regexp.Compile(r.BindDN)
+			if err != nil {
+				return nil, fmt.Errorf("route %d: invalid bindDN regex: %w", i, err)
+			}
+			r.bindDNRe = re
+		}
+	}
+
+	backends = make(map[string]*Backend, len(cfg.Backends))
+	pools = make(map[string]*backendPool, len(cfg.Backends))
+	for name, bc := range cfg.Backends {
+		b := &Backend{
+			Name:         name,
+			Address:      bc.Address,
+			DialTimeout:  bc.DialTimeout,
+			ReadTimeout:  bc.ReadTimeout,
+			WriteTimeout: bc.WriteTimeout,
+		}
+		if bc.TLS {
+			tlsCfg, err := loadClientTLSConfig(bc.TLSCA, bc.TLSInsecure)
+			if err != nil {
+				return nil, fmt.Errorf("backend %q: %w", name, err)
+			}
+			b.TLSConfig = tlsCfg
+		}
+		backends[name] = b
+		pools[name] = newBackendPool(b)
+	}
+
+	return &cfg, nil
+}
+
+// pooledConn is a backend connection that can be recycled through its
+// backendPool's idle list.
+type pooledConn struct {
+	net.Conn
+	backend  *Backend
+	lastUsed time.Time
+
+	// authenticated is set once a routedSession binds this connection as
+	// anything other than anonymous. LDAP bind state lives on the
+	// connection, not the client session, so an authenticated conn must
+	// never be handed to a different session via the idle pool.
+	authenticated bool
+
+	// unusable is set by pumpResponses if it exits for any reason other
+	// than its session stopping cleanly, eg. a write to the client
+	// failing with a response still buffered behind it on the backend
+	// socket: the connection would hand that stale, unread response to
+	// whichever session leases it next, so it must be closed rather than
+	// pooled.
+	unusable bool
+
+	// upstreamIDSeq hands out the messageIDs a routedSession rewrites
+	// client requests to before writing them to this connection. It
+	// belongs to the connection, not whichever session currently leases
+	// it, and never resets: a pooled conn outlives many sessions, and a
+	// response that's still in flight (eg. sitting in the kernel socket
+	// buffer) when one session hands the conn back would otherwise be
+	// read by the next lease under an upstreamID that session's own
+	// counter could reissue, misdelivering it to the wrong client.
+	// Counting up across the connection's whole lifetime instead of
+	// restarting per lease means a stale response's upstreamID can never
+	// collide with one a later session assigns.
+	upstreamIDSeq int64
+}
+
+// nextUpstreamID returns the next messageID to use on c, unique for as
+// long as c lives regardless of how many routedSessions lease it.
+func (c *pooledConn) nextUpstreamID() int64 {
+	return atomic.AddInt64(&c.upstreamIDSeq, 1)
+}
+
+// backendPool keeps a small set of idle, health-checked connections to one
+// backend so routed sessions don't have to dial on every use.
+type backendPool struct {
+	backend *Backend
+	mu      sync.Mutex
+	idle    []*pooledConn
+}
+
+func newBackendPool(b *Backend) *backendPool {
+	return &backendPool{backend: b}
+}
+
+// get returns a healthy idle connection if one is available, otherwise
+// dials a new one.
+func (p *backendPool) get() (*pooledConn, error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		c := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+		if healthCheck(c) {
+			return c, nil
+		}
+		c.Close()
+		p.mu.Lock()
+	}
+	p.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: p.backend.DialTimeout}
+	var conn net.Conn
+	var err error
+	if p.backend.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(&dialer, "tcp", p.backend.Address, p.backend.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", p.backend.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dialing backend %q: %w", p.backend.Name, err)
+	}
+	return &pooledConn{Conn: conn, backend: p.backend}, nil
+}
+
+// put returns c to the idle pool for later reuse, unless a session left it
+// bound as a non-anonymous identity: that credential must not leak to
+// whichever session leases the connection next, and the proxy has no
+// upstream re-bind to reset it, so such a connection is closed instead of
+// pooled.
+func (p *backendPool) put(c *pooledConn) {
+	if c.authenticated || c.unusable {
+		c.Close()
+		return
+	}
+	c.Conn.SetDeadline(time.Time{})
+	c.lastUsed = time.Now()
+	p.mu.Lock()
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+}
+
+// evictIdle closes and drops idle connections that have sat unused longer
+// than maxIdle.
+func (p *backendPool) evictIdle(maxIdle time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	kept := p.idle[:0]
+	for _, c := range p.idle {
+		if time.Since(c.lastUsed) > maxIdle {
+			c.Close()
+			continue
+		}
+		kept = append(kept, c)
+	}
+	p.idle = kept
+}
+
+// healthCheck is a cheap liveness probe: a backend that has sent an
+// unsolicited "Notice of Disconnection" or simply closed the socket will
+// fail a short, non-blocking read; anything else (including a timeout,
+// meaning the connection is still open and idle) counts as healthy.
+func healthCheck(c *pooledConn) bool {
+	c.Conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	one := make([]byte, 1)
+	_, err := c.Conn.Read(one)
+	if err == nil {
+		// Unexpected unsolicited data; treat the connection as unusable
+		// rather than try to make sense of it.
+		return false
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return false
+}
+
+// startPoolJanitor periodically evicts idle connections from every backend
+// pool. Called once at startup when routing is enabled.
+func startPoolJanitor(maxIdle time.Duration) {
+	go func() {
+		for range time.Tick(maxIdle / 2) {
+			for _, p := range pools {
+				p.evictIdle(maxIdle)
+			}
+		}
+	}()
+}
+
+// pumpPollInterval bounds how long pumpResponses will block waiting for the
+// next backend response before rechecking stopCh, so a session shutdown
+// isn't delayed by a backend that simply has nothing to send right now.
+const pumpPollInterval = 2 * time.Second
+
+// isTerminalResponseTag reports whether tag ends a request/response cycle
+// for a given upstream messageID, so routedSession can stop tracking it.
+// SearchResultEntry shares its messageID with the SearchResultDone that
+// follows it, so it must NOT be treated as terminal.
+func isTerminalResponseTag(tag ber.Tag) bool {
+	switch tag {
+	case tagBindResponse, tagSearchResDone, tagModifyResponse, ber.Tag(tagExtendedResponse),
+		tagAddResponse, tagDelResponse, tagModDNResponse, tagCompareResponse:
+		return true
+	}
+	return false
+}
+
+// requestControls returns an LDAP message's controls envelope (its third
+// top-level child, SEQUENCE{messageID, op, controls}), or nil if it didn't
+// carry one.
+func requestControls(packet *ber.Packet) *ber.Packet {
+	if len(packet.Children) > 2 {
+		return packet.Children[2]
+	}
+	return nil
+}
+
+// routedSession tracks, for one client connection, which backend handles
+// which message and the mapping from the upstream (proxy-assigned)
+// messageID back to the client's original one.
+type routedSession struct {
+	client net.Conn
+	cfg    *RouterConfig
+
+	mu           sync.Mutex
+	backendConns map[string]*pooledConn
+	pending      map[string]map[int64]int64 // backend -> upstreamID -> clientID
+	stopCh       chan struct{}
+	pumpWG       sync.WaitGroup
+}
+
+// handleRoutedConn replaces handleConn when -router-config is set: it owns
+// the client connection directly and fans requests out to the right
+// backend instead of piping everything to a single upstream. It runs the
+// same StartTLS/NTLM interception, rectifier rules and metrics/logging as
+// handleRequest, so enabling routing doesn't silently drop those features
+// for routed traffic.
+func handleRoutedConn(client net.Conn, cfg *RouterConfig) {
+	log.Println("New routed connection from: ", client.RemoteAddr())
+
+	// sc lets a StartTLS termination upgrade the connection in place and
+	// be observed by both this loop and every pumpResponses goroutine
+	// writing back to the client concurrently; sc.writeMu also serializes
+	// those writes against each other and against the handshake itself,
+	// same as handleConn's non-routed sharedConn.
+	sc := newSharedConn(client)
+
+	defer func() {
+		if r := recover(); r != nil {
+			logPanicRecovery(r)
+		}
+	}()
+
+	sess := &routedSession{
+		client:       sc,
+		cfg:          cfg,
+		backendConns: make(map[string]*pooledConn),
+		pending:      make(map[string]map[int64]int64),
+		stopCh:       make(chan struct{}),
+	}
+	defer sess.close()
+	defer ntlmForget(sc)
+
+	metricsActiveSessions.Inc()
+	defer metricsActiveSessions.Dec()
+
+	buf := bufio.NewReader(sc)
+	for {
+		// Wait for the next message to start arriving; if nothing shows up
+		// within idleTimeout the connection is considered idle and closed
+		if idleTimeout > 0 {
+			sc.SetReadDeadline(time.Now().Add(idleTimeout))
+			if _, err := buf.Peek(1); err != nil {
+				log.Println("router: client read error (idle):", err)
+				return
+			}
+		}
+
+		// Reject an oversized message before ber.ReadPacket allocates
+		// anything for it, by peeking its BER length header first
+		if maxMessageSize > 0 {
+			size, err := peekBERLength(buf)
+			if errors.Is(err, errUnsupportedBERLength) {
+				log.Printf("router: rejecting unparseable LDAP message length header: %v\n", err)
+				return
+			}
+			if err == nil && size > maxMessageSize {
+				log.Printf("router: rejecting oversized LDAP message: %d bytes (max %d)\n", size, maxMessageSize)
+				return
+			}
+		}
+
+		start := time.Now()
+		if readTimeout > 0 {
+			sc.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+		packet, err := ber.ReadPacket(buf)
+		if err != nil {
+			log.Println("router: client read error:", err)
+			return
+		}
+		bytesIn := len(packet.Bytes())
+		metricsBytes.WithLabelValues("client to proxy (routed)", "in").Add(float64(bytesIn))
+
+		if len(packet.Children) < 2 {
+			log.Println("router: invalid packet: no op found")
+			continue
+		}
+		if packet.Children[0].Tag != ber.TagInteger {
+			log.Println("router: unrecognized messageID", packet.Children[0].Value)
+			continue
+		}
+		clientID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		opName := "unknown"
+		if n, ok := opNames[op.Tag]; ok {
+			opName = n
+		}
+		metricsOps.WithLabelValues(opName).Inc()
+
+		// Intercept StartTLS exactly like handleRequest: answer with a
+		// synthetic success ExtendedResponse and upgrade sc in place
+		// instead of routing the request to a backend.
+		if starttlsTerminate && isStartTLSRequest(op) {
+			log.Println("router: StartTLS requested by client, terminating locally")
+			if err := terminateStartTLS(sc, clientID); err != nil {
+				log.Println("router: error terminating StartTLS:", err)
+				return
+			}
+			buf = bufio.NewReader(sc)
+			continue
+		}
+
+		// Intercept SASL/NTLM binds exactly like handleRequest: the proxy
+		// terminates the NTLM handshake itself and answers the client
+		// directly, without ever routing it to a backend. GSS-SPNEGO
+		// falls through to the normal route/rectify/forward path below.
+		if op.Tag == tagBindRequest {
+			if mech, creds, ok := saslBindAuth(op); ok && mech == ntlmMechanism {
+				log.Println("router: NTLM SASL bind requested")
+				if err := handleNTLMBind(sc, clientID, creds); err != nil {
+					log.Println("router: error handling NTLM bind:", err)
+					return
+				}
+				continue
+			}
+		}
+
+		// searchRequest synthesis answers the client directly and never
+		// reaches a backend, same as handleRequest.
+		if rule, ok := matchSearchSynthesize(op); ok {
+			if err := sendSynthesizedSearchResult(sc, clientID, rule); err != nil {
+				log.Println("router: error sending synthesized search result:", err)
+				return
+			}
+			continue
+		}
+
+		backendName := sess.route(op)
+		if backendName == "" {
+			log.Println("router: no backend matched messageID", clientID)
+			continue
+		}
+
+		bc, err := sess.backendFor(backendName)
+		if err != nil {
+			log.Println("router: ", err)
+			return
+		}
+
+		controls := requestControls(packet)
+
+		// Apply the same rectifier rules as handleRequest: a matched rule
+		// may forward unchanged, rewrite the op in place, or synthesize a
+		// deny/success response that must go straight back to the client
+		// instead of being routed to a backend at all.
+		d, rectified, sendback := rectifyData(op)
+
+		var out []byte
+		if rectified && sendback {
+			out = wrapMessage(clientID, d)
+			if writeTimeout > 0 {
+				sc.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			if _, err := sc.Write(out); err != nil {
+				log.Println("router: writing to client:", err)
+				return
+			}
+		} else {
+			// Only a bind that's actually reaching the backend below
+			// establishes an identity on it; a bind a rectifier rule
+			// denied or answered itself above never touched bc, so
+			// marking it authenticated here would strand a perfectly
+			// reusable anonymous connection (pool.put closes anything
+			// authenticated rather than risk leaking it to another
+			// session).
+			if opName == "bindRequest" {
+				bindDN := ""
+				if len(op.Children) >= 2 {
+					bindDN = string(op.Children[1].Data.Bytes())
+				}
+				// A SASL bind conventionally leaves bindDN (the "name"
+				// field) empty even though it does establish an
+				// identity: the real identity lives in the SASL
+				// credentials, which this proxy forwards unexamined for
+				// GSS-SPNEGO (NTLM is terminated above and never
+				// reaches here).
+				_, _, sasl := saslBindAuth(op)
+				bc.authenticated = bindDN != "" || sasl
+			}
+
+			upstreamID := bc.nextUpstreamID()
+			sess.track(backendName, upstreamID, clientID)
+
+			out = wrapMessage(upstreamID, d, controls)
+			if bc.backend.WriteTimeout > 0 {
+				bc.Conn.SetWriteDeadline(time.Now().Add(bc.backend.WriteTimeout))
+			} else if writeTimeout > 0 {
+				bc.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			if _, err := bc.Write(out); err != nil {
+				log.Println("router: writing to backend", backendName, ":", err)
+				return
+			}
+		}
+		metricsBytes.WithLabelValues("client to proxy (routed)", "out").Add(float64(len(out)))
+
+		duration := time.Since(start)
+		metricsOpDuration.WithLabelValues(opName).Observe(duration.Seconds())
+		logLDAPEvent("client to proxy (routed)", clientID, opName, packet, duration, bytesIn, len(out), rectified, sendback)
+		if slowOpThreshold > 0 && duration >= slowOpThreshold {
+			log.Printf("SLOW OP: client to proxy (routed) msgID=%d op=%s duration=%s\n%s", clientID, opName, duration, hex.Dump(packet.Bytes()))
+		}
+	}
+}
+
+// route picks a backend name for op, matching bindDN for BindRequest and
+// baseDN for SearchRequest/ModifyRequest, falling back to cfg.Default.
+func (s *routedSession) route(op *ber.Packet) string {
+	switch opNames[op.Tag] {
+	case "bindRequest":
+		if len(op.Children) >= 2 {
+			bindDN := string(op.Children[1].Data.Bytes())
+			for _, r := range s.cfg.Routes {
+				if r.bindDNRe != nil && r.bindDNRe.MatchString(bindDN) {
+					return r.Backend
+				}
+			}
+		}
+	case "searchRequest", "modifyRequest":
+		if len(op.Children) >= 1 {
+			baseDN := string(op.Children[0].Data.Bytes())
+			for _, r := range s.cfg.Routes {
+				if r.baseDNRe != nil && r.baseDNRe.MatchString(baseDN) {
+					return r.Backend
+				}
+			}
+		}
+	}
+	return s.cfg.Default
+}
+
+// backendFor returns the dedicated connection this session uses for
+// backendName, leasing one from the pool and starting its response pump
+// on first use.
+func (s *routedSession) backendFor(backendName string) (*pooledConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if bc, ok := s.backendConns[backendName]; ok {
+		return bc, nil
+	}
+	pool, ok := pools[backendName]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", backendName)
+	}
+	bc, err := pool.get()
+	if err != nil {
+		return nil, err
+	}
+	s.backendConns[backendName] = bc
+	s.pumpWG.Add(1)
+	go s.pumpResponses(backendName, bc)
+	return bc, nil
+}
+
+// pumpResponses relays every response read from bc back to the client,
+// rewriting the upstream messageID back to the client's original one.
+func (s *routedSession) pumpResponses(backendName string, bc *pooledConn) {
+	defer s.pumpWG.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			logPanicRecovery(r)
+			bc.unusable = true
+		}
+	}()
+	metricsActiveSessions.Inc()
+	defer metricsActiveSessions.Dec()
+
+	buf := bufio.NewReader(bc)
+	for {
+		select {
+		case <-s.stopCh:
+			// A response already read off the wire into buf but not yet
+			// parsed/forwarded would be silently lost once this conn is
+			// handed to the next session, which wraps it in a brand new
+			// bufio.Reader: don't pool it in that case.
+			if buf.Buffered() > 0 {
+				bc.unusable = true
+			}
+			return
+		default:
+		}
+
+		// Wait for the next response to start arriving, rechecking
+		// stopCh every pumpPollInterval so an idle backend (nothing
+		// outstanding right now) doesn't delay a session shutdown.
+		bc.Conn.SetReadDeadline(time.Now().Add(pumpPollInterval))
+		if _, err := buf.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			log.Println("router: backend", backendName, "read error:", err)
+			bc.unusable = true
+			return
+		}
+
+		// Reject an oversized response before ber.ReadPacket allocates
+		// anything for it, same as handleRequest does for the client
+		// side: a backend is just as capable of sending an outsized
+		// message as a client is.
+		if maxMessageSize > 0 {
+			size, err := peekBERLength(buf)
+			if errors.Is(err, errUnsupportedBERLength) {
+				log.Printf("router: rejecting unparseable response length header from backend %s: %v\n", backendName, err)
+				bc.unusable = true
+				return
+			}
+			if err == nil && size > maxMessageSize {
+				log.Printf("router: rejecting oversized response from backend %s: %d bytes (max %d)\n", backendName, size, maxMessageSize)
+				bc.unusable = true
+				return
+			}
+		}
+
+		// A response has started arriving: bound how long we'll wait for
+		// the rest of it using the backend's configured ReadTimeout,
+		// same as handleRequest does for the non-routed path.
+		start := time.Now()
+		if bc.backend.ReadTimeout > 0 {
+			bc.Conn.SetReadDeadline(time.Now().Add(bc.backend.ReadTimeout))
+		} else {
+			bc.Conn.SetReadDeadline(time.Time{})
+		}
+		packet, err := ber.ReadPacket(buf)
+		if err != nil {
+			log.Println("router: backend", backendName, "read error:", err)
+			bc.unusable = true
+			return
+		}
+		bytesIn := len(packet.Bytes())
+		metricsBytes.WithLabelValues("server to proxy (routed)", "in").Add(float64(bytesIn))
+
+		if len(packet.Children) < 2 {
+			continue
+		}
+		if packet.Children[0].Tag != ber.TagInteger {
+			log.Println("router: backend", backendName, "sent unrecognized upstream messageID", packet.Children[0].Value)
+			continue
+		}
+		upstreamID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		controls := requestControls(packet)
+
+		opName := "unknown"
+		if n, ok := opNames[op.Tag]; ok {
+			opName = n
+		}
+		metricsOps.WithLabelValues(opName).Inc()
+
+		clientID, ok := s.lookup(backendName, upstreamID)
+		if !ok {
+			log.Println("router: response for unknown upstream messageID", upstreamID, "from", backendName)
+			continue
+		}
+
+		// Responses can only be rewritten in place (eg. a searchResEntry
+		// rule), never synthesized or denied: that only makes sense for
+		// a request that hasn't reached a real server yet.
+		d, rectified, _ := rectifyData(op)
+
+		out := wrapMessage(clientID, d, controls)
+		if writeTimeout > 0 {
+			s.client.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		if _, err := s.client.Write(out); err != nil {
+			log.Println("router: writing to client:", err)
+			// A response may still be buffered behind this one on bc;
+			// leaving it there and pooling bc would hand it, unread, to
+			// whichever session leases bc next.
+			bc.unusable = true
+			return
+		}
+		metricsBytes.WithLabelValues("server to proxy (routed)", "out").Add(float64(len(out)))
+
+		duration := time.Since(start)
+		metricsOpDuration.WithLabelValues(opName).Observe(duration.Seconds())
+		logLDAPEvent("server to proxy (routed)", clientID, opName, packet, duration, bytesIn, len(out), rectified, false)
+		if slowOpThreshold > 0 && duration >= slowOpThreshold {
+			log.Printf("SLOW OP: server to proxy (routed) msgID=%d op=%s duration=%s\n%s", clientID, opName, duration, hex.Dump(packet.Bytes()))
+		}
+
+		if isTerminalResponseTag(d.Tag) {
+			s.forget(backendName, upstreamID)
+		}
+	}
+}
+
+func (s *routedSession) track(backendName string, upstreamID, clientID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.pending[backendName]
+	if !ok {
+		m = make(map[int64]int64)
+		s.pending[backendName] = m
+	}
+	m[upstreamID] = clientID
+}
+
+func (s *routedSession) lookup(backendName string, upstreamID int64) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.pending[backendName]
+	if !ok {
+		return 0, false
+	}
+	clientID, ok := m[upstreamID]
+	return clientID, ok
+}
+
+func (s *routedSession) forget(backendName string, upstreamID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending[backendName], upstreamID)
+}
+
+// close stops every response pump and returns this session's backend
+// connections to their pools. It waits for each pump goroutine to actually
+// exit before handing its connection back, since pumpResponses only checks
+// stopCh between reads: releasing the connection to the pool any earlier
+// would let a pump still blocked in ber.ReadPacket race a future lease of
+// the same conn.
+func (s *routedSession) close() {
+	close(s.stopCh)
+	s.client.Close()
+	s.pumpWG.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, bc := range s.backendConns {
+		pools[name].put(bc)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func TestRouteBindRequestMatchesBindDN(t *testing.T) {
+	s := &routedSession{cfg: &RouterConfig{
+		Default: "fallback",
+		Routes: []RouteConfig{
+			{Backend: "admins", bindDNRe: regexp.MustCompile("^cn=admin,")},
+		},
+	}}
+
+	if got := s.route(fakeBindRequest("cn=admin,dc=example,dc=com")); got != "admins" {
+		t.Errorf("route() = %q, want %q", got, "admins")
+	}
+	if got := s.route(fakeBindRequest("cn=guest,dc=example,dc=com")); got != "fallback" {
+		t.Errorf("route() = %q, want default %q", got, "fallback")
+	}
+}
+
+func TestRouteSearchRequestMatchesBaseDN(t *testing.T) {
+	s := &routedSession{cfg: &RouterConfig{
+		Default: "fallback",
+		Routes: []RouteConfig{
+			{Backend: "people", baseDNRe: regexp.MustCompile("^ou=people,")},
+		},
+	}}
+
+	if got := s.route(fakeSearchRequest("ou=people,dc=example,dc=com", nil)); got != "people" {
+		t.Errorf("route() = %q, want %q", got, "people")
+	}
+	if got := s.route(fakeSearchRequest("ou=groups,dc=example,dc=com", nil)); got != "fallback" {
+		t.Errorf("route() = %q, want default %q", got, "fallback")
+	}
+}
+
+func TestIsTerminalResponseTag(t *testing.T) {
+	terminal := []ber.Tag{
+		tagBindResponse, tagSearchResDone, tagModifyResponse, ber.Tag(tagExtendedResponse),
+		tagAddResponse, tagDelResponse, tagModDNResponse, tagCompareResponse,
+	}
+	for _, tag := range terminal {
+		if !isTerminalResponseTag(tag) {
+			t.Errorf("isTerminalResponseTag(%d) = false, want true", tag)
+		}
+	}
+
+	// SearchResultEntry shares its messageID with the SearchResultDone
+	// that follows it, so it must never be treated as terminal.
+	if isTerminalResponseTag(tagSearchResEntry) {
+		t.Error("isTerminalResponseTag(searchResEntry) = true, want false")
+	}
+}
+
+// closeTrackingConn wraps a net.Conn to record whether Close was called,
+// so pool tests can tell a returned connection was discarded rather than
+// pooled without depending on internal pool state.
+type closeTrackingConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closeTrackingConn) Close() error {
+	c.closed = true
+	return c.Conn.Close()
+}
+
+func TestBackendPoolPutDiscardsAuthenticated(t *testing.T) {
+	client, backend := net.Pipe()
+	defer backend.Close()
+	tracked := &closeTrackingConn{Conn: client}
+
+	p := newBackendPool(&Backend{Name: "b1"})
+	p.put(&pooledConn{Conn: tracked, authenticated: true})
+
+	if len(p.idle) != 0 {
+		t.Error("expected an authenticated connection not to be pooled")
+	}
+	if !tracked.closed {
+		t.Error("expected an authenticated connection to be closed")
+	}
+}
+
+func TestBackendPoolPutDiscardsUnusable(t *testing.T) {
+	client, backend := net.Pipe()
+	defer backend.Close()
+	tracked := &closeTrackingConn{Conn: client}
+
+	p := newBackendPool(&Backend{Name: "b1"})
+	p.put(&pooledConn{Conn: tracked, unusable: true})
+
+	if len(p.idle) != 0 {
+		t.Error("expected an unusable connection not to be pooled")
+	}
+	if !tracked.closed {
+		t.Error("expected an unusable connection to be closed")
+	}
+}
+
+func TestBackendPoolPutReturnsReusableConnToIdle(t *testing.T) {
+	client, backend := net.Pipe()
+	defer backend.Close()
+	tracked := &closeTrackingConn{Conn: client}
+
+	p := newBackendPool(&Backend{Name: "b1"})
+	c := &pooledConn{Conn: tracked}
+	p.put(c)
+
+	if len(p.idle) != 1 || p.idle[0] != c {
+		t.Error("expected a plain anonymous connection to be pooled for reuse")
+	}
+	if tracked.closed {
+		t.Error("expected a pooled connection not to be closed")
+	}
+}
+
+func TestBackendPoolGetReusesHealthyIdleConn(t *testing.T) {
+	client, backend := net.Pipe()
+	defer backend.Close()
+
+	p := newBackendPool(&Backend{Name: "b1"})
+	want := &pooledConn{Conn: client}
+	p.idle = append(p.idle, want)
+
+	got, err := p.get()
+	if err != nil {
+		t.Fatalf("get() error: %v", err)
+	}
+	if got != want {
+		t.Error("expected get() to reuse the idle connection instead of dialing")
+	}
+	if len(p.idle) != 0 {
+		t.Error("expected get() to remove the connection from the idle list")
+	}
+}
+
+func TestBackendPoolGetDropsDeadIdleConn(t *testing.T) {
+	client, backend := net.Pipe()
+	backend.Close() // closed peer: client-side reads fail instead of timing out
+
+	p := newBackendPool(&Backend{Name: "b1", Address: "127.0.0.1:1"})
+	dead := &pooledConn{Conn: client}
+	p.idle = append(p.idle, dead)
+
+	// No listener on 127.0.0.1:1, so the fallback dial fails too; this
+	// only verifies the dead idle conn was discarded rather than reused.
+	if _, err := p.get(); err == nil {
+		t.Fatal("expected get() to fail once the idle conn is dead and dialing fails")
+	}
+	if len(p.idle) != 0 {
+		t.Error("expected the dead idle connection to be dropped")
+	}
+}
@@ -0,0 +1,419 @@
+// rules.go: LDAP-protocol-aware rectifier rules, loaded from the
+// -config YAML/JSON file instead of the old hardcoded byte patterns.
+// Each Rule matches on decoded LDAP message fields (baseDN, filter,
+// bindDN, attributes, extended OID) for a given operation and either
+// forwards, rewrites, synthesizes or denies it.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// rules holds the rectifier rules loaded at startup by loadRules; empty
+// (no rectification) until -config is set
+var rules []Rule
+
+// LDAP application tags this proxy can match on
+const (
+	tagBindRequest    = ber.Tag(0)
+	tagSearchRequest  = ber.Tag(3)
+	tagSearchResEntry = ber.Tag(4)
+	tagSearchResDone  = ber.Tag(5)
+	tagModifyRequest  = ber.Tag(6)
+	tagModifyResponse = ber.Tag(7)
+	tagBindResponse   = ber.Tag(1)
+	tagExtendedReq    = ber.Tag(23)
+
+	// Add/Delete/ModifyDN/Compare aren't matched on by rectifier rules
+	// (no opNames entry), but the router still needs their response
+	// tags to stop tracking a forwarded request's messageID.
+	tagAddResponse     = ber.Tag(9)
+	tagDelResponse     = ber.Tag(11)
+	tagModDNResponse   = ber.Tag(13)
+	tagCompareResponse = ber.Tag(15)
+)
+
+// opNames maps the LDAP application tags we understand to the rule "op"
+// names used in the config file
+var opNames = map[ber.Tag]string{
+	tagBindRequest:    "bindRequest",
+	tagSearchRequest:  "searchRequest",
+	tagSearchResEntry: "searchResEntry",
+	tagModifyRequest:  "modifyRequest",
+	tagExtendedReq:    "extendedReq",
+}
+
+// Rule describes a single rectifier rule: match an LDAP message of type
+// Op against Match, then apply Action to it
+type Rule struct {
+	Name       string          `yaml:"name,omitempty" json:"name,omitempty"` // used only for the rectifier_hits metric; defaults to "<op>-<index>"
+	Op         string          `yaml:"op" json:"op"`
+	Match      RuleMatch       `yaml:"match" json:"match"`
+	Action     string          `yaml:"action" json:"action"` // forward|rewrite|synthesize|deny
+	Rewrite    *RuleRewrite    `yaml:"rewrite,omitempty" json:"rewrite,omitempty"`
+	Synthesize *RuleSynthesize `yaml:"synthesize,omitempty" json:"synthesize,omitempty"`
+	Deny       *RuleDeny       `yaml:"deny,omitempty" json:"deny,omitempty"`
+
+	baseDNRe *regexp.Regexp
+	bindDNRe *regexp.Regexp
+}
+
+// RuleMatch is the subset of LDAP message fields a rule can match on
+type RuleMatch struct {
+	BaseDN      string   `yaml:"baseDN,omitempty" json:"baseDN,omitempty"`
+	Filter      string   `yaml:"filter,omitempty" json:"filter,omitempty"`
+	Attributes  []string `yaml:"attributes,omitempty" json:"attributes,omitempty"`
+	BindDN      string   `yaml:"bindDN,omitempty" json:"bindDN,omitempty"`
+	ExtendedOID string   `yaml:"extendedOID,omitempty" json:"extendedOID,omitempty"`
+}
+
+// RuleRewrite describes an in-place mutation of the matched message
+type RuleRewrite struct {
+	BaseDN string `yaml:"baseDN,omitempty" json:"baseDN,omitempty"`
+}
+
+// RuleSynthesize describes a response built locally instead of forwarded
+type RuleSynthesize struct {
+	ResultCode int                `yaml:"resultCode" json:"resultCode"`
+	Entries    []SynthesizedEntry `yaml:"entries,omitempty" json:"entries,omitempty"`
+}
+
+// SynthesizedEntry is one SearchResultEntry synthesized for a searchRequest
+type SynthesizedEntry struct {
+	DN         string              `yaml:"dn" json:"dn"`
+	Attributes map[string][]string `yaml:"attributes" json:"attributes"`
+}
+
+// RuleDeny describes the error result sent back for a denied message
+type RuleDeny struct {
+	ResultCode int    `yaml:"resultCode" json:"resultCode"`
+	Message    string `yaml:"message,omitempty" json:"message,omitempty"`
+}
+
+// loadRules reads and validates the rule config at path. YAML is assumed
+// unless the file ends in .json.
+func loadRules(path string) ([]Rule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading rule config: %w", err)
+	}
+
+	var rs []Rule
+	if strings.HasSuffix(path, ".json") {
+		if err := json.Unmarshal(data, &rs); err != nil {
+			return nil, fmt.Errorf("parsing JSON rule config: %w", err)
+		}
+	} else {
+		if err := yaml.Unmarshal(data, &rs); err != nil {
+			return nil, fmt.Errorf("parsing YAML rule config: %w", err)
+		}
+	}
+
+	for i := range rs {
+		if rs[i].Match.BaseDN != "" {
+			re, err := regexp.Compile(rs[i].Match.BaseDN)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid baseDN regex: %w", i, err)
+			}
+			rs[i].baseDNRe = re
+		}
+		if rs[i].Match.BindDN != "" {
+			re, err := regexp.Compile(rs[i].Match.BindDN)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid bindDN regex: %w", i, err)
+			}
+			rs[i].bindDNRe = re
+		}
+		if rs[i].Match.Filter != "" {
+			if _, err := ldap.CompileFilter(rs[i].Match.Filter); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid filter: %w", i, err)
+			}
+		}
+		if rs[i].Action == "synthesize" && rs[i].Synthesize == nil {
+			return nil, fmt.Errorf("rule %d: action \"synthesize\" requires a synthesize block", i)
+		}
+		if rs[i].Action == "deny" && rs[i].Deny == nil {
+			return nil, fmt.Errorf("rule %d: action \"deny\" requires a deny block", i)
+		}
+	}
+	return rs, nil
+}
+
+// rectifyData matches op against the loaded rules and applies the first
+// one that matches, returning the (possibly rewritten or synthesized)
+// packet to send, whether it was rectified, and whether it must be sent
+// back to the originator instead of forwarded upstream.
+func rectifyData(op *ber.Packet) (*ber.Packet, bool, bool) {
+	opName, ok := opNames[op.Tag]
+	if !ok {
+		logVerbosef("rectifyData: unhandled op tag %d, forwarding unchanged\n", op.Tag)
+		return op, false, false
+	}
+
+	for i, rule := range rules {
+		if rule.Op != opName || !ruleMatches(rule, op) {
+			continue
+		}
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", rule.Op, i)
+		}
+		logVerbosef("rectifyData [%s %s]: matched\n", name, rule.Action)
+		if rule.Action == "forward" {
+			return op, false, false
+		}
+		metricsRectifierHits.WithLabelValues(name, rule.Action).Inc()
+		switch rule.Action {
+		case "rewrite":
+			return rewriteOp(op, rule), true, false
+		case "synthesize":
+			return synthesizeOp(opName, rule), true, true
+		case "deny":
+			return denyOp(opName, rule), true, true
+		default: // unknown action: leave the message untouched
+			return op, false, false
+		}
+	}
+	return op, false, false
+}
+
+// ruleMatches reports whether op (an LDAP message of the op's own type)
+// satisfies rule.Match.
+func ruleMatches(rule Rule, op *ber.Packet) bool {
+	switch rule.Op {
+	case "bindRequest":
+		if len(op.Children) < 2 {
+			return false
+		}
+		bindDN := string(op.Children[1].Data.Bytes())
+		return rule.bindDNRe == nil || rule.bindDNRe.MatchString(bindDN)
+
+	case "searchRequest":
+		if len(op.Children) < 8 {
+			return false
+		}
+		baseDN := string(op.Children[0].Data.Bytes())
+		if rule.baseDNRe != nil && !rule.baseDNRe.MatchString(baseDN) {
+			return false
+		}
+		if rule.Match.Filter != "" {
+			filterStr, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil || filterStr != rule.Match.Filter {
+				return false
+			}
+		}
+		if len(rule.Match.Attributes) > 0 {
+			requested := make(map[string]bool, len(op.Children[7].Children))
+			for _, a := range op.Children[7].Children {
+				requested[string(a.Data.Bytes())] = true
+			}
+			for _, want := range rule.Match.Attributes {
+				if !requested[want] {
+					return false
+				}
+			}
+		}
+		return true
+
+	case "searchResEntry":
+		if len(op.Children) < 1 {
+			return false
+		}
+		dn := string(op.Children[0].Data.Bytes())
+		return rule.baseDNRe == nil || rule.baseDNRe.MatchString(dn)
+
+	case "modifyRequest":
+		if len(op.Children) < 1 {
+			return false
+		}
+		baseDN := string(op.Children[0].Data.Bytes())
+		return rule.baseDNRe == nil || rule.baseDNRe.MatchString(baseDN)
+
+	case "extendedReq":
+		if len(op.Children) < 1 {
+			return false
+		}
+		oid := string(op.Children[0].Data.Bytes())
+		return rule.Match.ExtendedOID == "" || oid == rule.Match.ExtendedOID
+
+	default:
+		return false
+	}
+}
+
+// rewriteOp mutates op's baseDN/bindDN child in place per rule.Rewrite and
+// returns it re-encoded.
+func rewriteOp(op *ber.Packet, rule Rule) *ber.Packet {
+	if rule.Rewrite == nil || rule.Rewrite.BaseDN == "" {
+		return op
+	}
+
+	idx := 0
+	switch rule.Op {
+	case "searchRequest", "modifyRequest", "searchResEntry":
+		idx = 0
+	case "bindRequest":
+		idx = 1
+	default:
+		return op
+	}
+	if idx >= len(op.Children) {
+		return op
+	}
+
+	desc := op.Children[idx].Description
+	op.Children[idx] = ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, rule.Rewrite.BaseDN, desc)
+	return op
+}
+
+// responseTagFor returns the application tag of the response PDU for a
+// given request op name.
+func responseTagFor(opName string) ber.Tag {
+	switch opName {
+	case "bindRequest":
+		return tagBindResponse
+	case "searchRequest":
+		// A "synthesize" searchRequest rule never reaches here (it's
+		// special-cased by matchSearchSynthesize, which needs
+		// SearchResultEntry children a single LDAPResult PDU can't
+		// carry), but a "deny" rule still goes through rectifyData
+		// like any other op and needs the right response tag.
+		return tagSearchResDone
+	case "modifyRequest":
+		return tagModifyResponse
+	case "extendedReq":
+		return ber.Tag(tagExtendedResponse)
+	default:
+		return tagBindResponse
+	}
+}
+
+// synthesizeOp builds a single-message success/failure response for ops
+// other than searchRequest (which needs SearchResultEntry children and is
+// handled separately by matchSearchSynthesize/sendSynthesizedSearchResult).
+func synthesizeOp(opName string, rule Rule) *ber.Packet {
+	rc := int64(0)
+	if rule.Synthesize != nil {
+		rc = int64(rule.Synthesize.ResultCode)
+	}
+	return synthesizeResult(responseTagFor(opName), rc, "", "")
+}
+
+// denyOp builds an error response for a denied message
+func denyOp(opName string, rule Rule) *ber.Packet {
+	rc := int64(50) // insufficientAccessRights
+	msg := ""
+	if rule.Deny != nil {
+		rc = int64(rule.Deny.ResultCode)
+		msg = rule.Deny.Message
+	}
+	return synthesizeResult(responseTagFor(opName), rc, "", msg)
+}
+
+// synthesizeResult builds an LDAPResult-shaped application PDU (resultCode,
+// matchedDN, diagnosticMessage), used for every response type but
+// SearchResultEntry.
+func synthesizeResult(tag ber.Tag, resultCode int64, matchedDN, message string) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "resultCode"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, matchedDN, "matchedDN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, "diagnosticMessage"))
+	return result
+}
+
+// matchSearchSynthesize returns the first enabled rule that synthesizes a
+// search result for this SearchRequest, if any.
+func matchSearchSynthesize(op *ber.Packet) (*Rule, bool) {
+	if op.Tag != tagSearchRequest {
+		return nil, false
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Op != "searchRequest" || rule.Action != "synthesize" {
+			continue
+		}
+		if ruleMatches(*rule, op) {
+			name := rule.Name
+			if name == "" {
+				name = fmt.Sprintf("%s-%d", rule.Op, i)
+			}
+			metricsRectifierHits.WithLabelValues(name, rule.Action).Inc()
+			return rule, true
+		}
+	}
+	return nil, false
+}
+
+// sendSynthesizedSearchResult writes a SearchResultEntry for each
+// configured entry followed by a SearchResultDone, all tagged with
+// messageID, directly to conn. SearchRequest synthesis can't reuse the
+// single-envelope path the other actions use because it spans more than
+// one LDAP message.
+func sendSynthesizedSearchResult(conn ldapWriter, messageID int64, rule *Rule) error {
+	rc := int64(0)
+	var entries []SynthesizedEntry
+	if rule.Synthesize != nil {
+		rc = int64(rule.Synthesize.ResultCode)
+		entries = rule.Synthesize.Entries
+	}
+
+	for _, entry := range entries {
+		if _, err := conn.Write(wrapMessage(messageID, synthesizeSearchResultEntry(entry))); err != nil {
+			return err
+		}
+	}
+
+	_, err := conn.Write(wrapMessage(messageID, synthesizeResult(tagSearchResDone, rc, "", "")))
+	return err
+}
+
+// ldapWriter is the minimal net.Conn surface sendSynthesizedSearchResult
+// needs, so it doesn't have to import net just for the parameter type.
+type ldapWriter interface {
+	Write([]byte) (int, error)
+}
+
+// wrapMessage envelopes op as a full LDAP message: SEQUENCE{messageID, op[,
+// controls]}. controls is optional and, when given (eg. by the router
+// forwarding a request/response's original controls envelope unchanged),
+// is appended as the message's controls [0] element.
+func wrapMessage(messageID int64, op *ber.Packet, controls ...*ber.Packet) []byte {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "messageID"))
+	envelope.AppendChild(op)
+	for _, c := range controls {
+		if c != nil {
+			envelope.AppendChild(c)
+		}
+	}
+	return envelope.Bytes()
+}
+
+// synthesizeSearchResultEntry builds a SearchResultEntry PDU for e.
+func synthesizeSearchResultEntry(e SynthesizedEntry) *ber.Packet {
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tagSearchResEntry, nil, "Search Result Entry")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "objectName"))
+
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range e.Attributes {
+		partial := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "partialAttribute")
+		partial.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, v := range values {
+			vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+		}
+		partial.AppendChild(vals)
+		attrs.AppendChild(partial)
+	}
+	entry.AppendChild(attrs)
+	return entry
+}
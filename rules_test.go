@@ -0,0 +1,126 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func fakeBindRequest(bindDN string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tagBindRequest, nil, "Bind Request")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(3), "version"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, bindDN, "bindDN"))
+	return op
+}
+
+// fakeSearchRequest builds a SearchRequest with the 8 children ruleMatches
+// expects; only baseDN and the requested attributes are populated, the
+// rest are placeholders a baseDN/attributes-only rule never looks at.
+func fakeSearchRequest(baseDN string, attributes []string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tagSearchRequest, nil, "Search Request")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, baseDN, "baseObject"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(0), "scope"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(0), "derefAliases"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "sizeLimit"))
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(0), "timeLimit"))
+	op.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "typesOnly"))
+	op.AppendChild(ber.Encode(ber.ClassContext, ber.TypePrimitive, ber.Tag(7), nil, "filter")) // present filter, unused here
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for _, a := range attributes {
+		attrs.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a, "attribute"))
+	}
+	op.AppendChild(attrs)
+	return op
+}
+
+// mustRule compiles r's regex fields the way loadRules would, so tests can
+// build a Rule literal without duplicating loadRules' own logic.
+func mustRule(t *testing.T, r Rule) Rule {
+	t.Helper()
+	if r.Match.BaseDN != "" {
+		r.baseDNRe = regexp.MustCompile(r.Match.BaseDN)
+	}
+	if r.Match.BindDN != "" {
+		r.bindDNRe = regexp.MustCompile(r.Match.BindDN)
+	}
+	return r
+}
+
+func TestRuleMatchesBindRequest(t *testing.T) {
+	rule := mustRule(t, Rule{Op: "bindRequest", Match: RuleMatch{BindDN: "^cn=admin,"}})
+
+	if !ruleMatches(rule, fakeBindRequest("cn=admin,dc=example,dc=com")) {
+		t.Error("expected bindDN regex to match")
+	}
+	if ruleMatches(rule, fakeBindRequest("cn=guest,dc=example,dc=com")) {
+		t.Error("expected bindDN regex not to match")
+	}
+}
+
+func TestRuleMatchesBindRequestNoPattern(t *testing.T) {
+	rule := Rule{Op: "bindRequest"}
+	if !ruleMatches(rule, fakeBindRequest("cn=anyone,dc=example,dc=com")) {
+		t.Error("a rule with no bindDN pattern should match every bind")
+	}
+}
+
+func TestRuleMatchesSearchRequestBaseDN(t *testing.T) {
+	rule := mustRule(t, Rule{Op: "searchRequest", Match: RuleMatch{BaseDN: "^ou=people,"}})
+
+	if !ruleMatches(rule, fakeSearchRequest("ou=people,dc=example,dc=com", nil)) {
+		t.Error("expected baseDN regex to match")
+	}
+	if ruleMatches(rule, fakeSearchRequest("ou=groups,dc=example,dc=com", nil)) {
+		t.Error("expected baseDN regex not to match")
+	}
+}
+
+func TestRuleMatchesSearchRequestAttributes(t *testing.T) {
+	rule := Rule{Op: "searchRequest", Match: RuleMatch{Attributes: []string{"mail", "cn"}}}
+
+	if !ruleMatches(rule, fakeSearchRequest("dc=example,dc=com", []string{"cn", "mail", "uid"})) {
+		t.Error("expected all requested attributes to be present")
+	}
+	if ruleMatches(rule, fakeSearchRequest("dc=example,dc=com", []string{"cn"})) {
+		t.Error("expected match to fail when a required attribute is missing")
+	}
+}
+
+func TestRuleMatchesTooFewChildren(t *testing.T) {
+	rule := Rule{Op: "bindRequest"}
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tagBindRequest, nil, "Bind Request")
+	if ruleMatches(rule, op) {
+		t.Error("expected no match when the op has too few children to inspect")
+	}
+}
+
+func TestRuleMatchesUnknownOp(t *testing.T) {
+	rule := Rule{Op: "unsupportedOp"}
+	if ruleMatches(rule, fakeBindRequest("cn=admin,dc=example,dc=com")) {
+		t.Error("expected an unrecognized op name never to match")
+	}
+}
+
+// TestRectifyDataDenySearchRequest covers the path matchSearchSynthesize
+// doesn't: a "deny" rule on a searchRequest goes through rectifyData, which
+// must tag the synthesized response SearchResultDone, not the default
+// BindResponse, or the client can't make sense of it.
+func TestRectifyDataDenySearchRequest(t *testing.T) {
+	orig := rules
+	defer func() { rules = orig }()
+	rules = []Rule{mustRule(t, Rule{
+		Op:     "searchRequest",
+		Match:  RuleMatch{BaseDN: "^ou=secret,"},
+		Action: "deny",
+		Deny:   &RuleDeny{ResultCode: 50, Message: "not allowed"},
+	})}
+
+	d, rectified, sendback := rectifyData(fakeSearchRequest("ou=secret,dc=example,dc=com", nil))
+	if !rectified || !sendback {
+		t.Fatalf("expected a denied searchRequest to be rectified and sent back, got rectified=%v sendback=%v", rectified, sendback)
+	}
+	if d.Tag != tagSearchResDone {
+		t.Errorf("expected a denied searchRequest's response to be tagged SearchResultDone (%d), got %d", tagSearchResDone, d.Tag)
+	}
+}
@@ -0,0 +1,164 @@
+// tlsproxy.go: TLS support for ldap-proxy, covering both "native" LDAPS
+// (TLS from the first byte, on either side of the proxy) and StartTLS
+// termination (a plaintext connection upgraded in place after an
+// ExtendedRequest).
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// OID of the LDAP StartTLS extended operation (RFC 4511 section 4.14.2)
+const oidStartTLS = "1.3.6.1.4.1.1466.20037"
+
+// LDAP ExtendedResponse application tag (RFC 4511 section 4.12)
+const tagExtendedResponse = 24
+
+// loadServerTLSConfig builds a tls.Config suitable for terminating LDAPS
+// (or StartTLS) on the client-facing side of the proxy.
+func loadServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// loadClientTLSConfig builds a tls.Config used when dialing the upstream
+// LDAP server over LDAPS.
+func loadClientTLSConfig(caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// isStartTLSRequest reports whether op is an ExtendedRequest carrying the
+// StartTLS OID as its requestName.
+func isStartTLSRequest(op *ber.Packet) bool {
+	if op == nil || op.ClassType != ber.ClassApplication || op.Tag != ber.Tag(23) {
+		return false
+	}
+	if len(op.Children) == 0 {
+		return false
+	}
+	return string(op.Children[0].Data.Bytes()) == oidStartTLS
+}
+
+// sharedConn is a net.Conn whose underlying connection can be swapped out
+// from under concurrent readers/writers. A client connection is handled by
+// two independent goroutines (one pumping client-to-proxy, one pumping
+// proxy-to-client), each holding its own reference to the *same* sharedConn
+// instance. When StartTLS termination upgrades the connection in place, it
+// calls upgrade() once; both goroutines' subsequent Read/Write calls
+// observe the upgraded *tls.Conn, instead of one goroutine upgrading a
+// local variable while the other keeps writing to the stale plaintext
+// socket.
+type sharedConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+
+	// writeMu serializes everything written to conn, including the raw
+	// handshake traffic terminateStartTLS writes directly to the
+	// pre-upgrade conn: without it, the sibling goroutine's Write could
+	// land on the socket in the middle of the handshake and corrupt it.
+	writeMu sync.Mutex
+}
+
+func newSharedConn(conn net.Conn) *sharedConn {
+	return &sharedConn{conn: conn}
+}
+
+func (s *sharedConn) current() net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// upgrade swaps in a new underlying connection, eg. after a StartTLS
+// handshake completes.
+func (s *sharedConn) upgrade(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn = conn
+}
+
+func (s *sharedConn) Read(b []byte) (int, error) { return s.current().Read(b) }
+func (s *sharedConn) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.current().Write(b)
+}
+func (s *sharedConn) Close() error         { return s.current().Close() }
+func (s *sharedConn) LocalAddr() net.Addr  { return s.current().LocalAddr() }
+func (s *sharedConn) RemoteAddr() net.Addr { return s.current().RemoteAddr() }
+
+func (s *sharedConn) SetDeadline(t time.Time) error      { return s.current().SetDeadline(t) }
+func (s *sharedConn) SetReadDeadline(t time.Time) error  { return s.current().SetReadDeadline(t) }
+func (s *sharedConn) SetWriteDeadline(t time.Time) error { return s.current().SetWriteDeadline(t) }
+
+// terminateStartTLS answers a StartTLS request with a synthetic success
+// ExtendedResponse (reusing the sendback path) and upgrades sc to TLS in
+// place using localTLSConfig, so that both the client-to-proxy and
+// proxy-to-client goroutines sharing sc see the same upgraded connection.
+// The caller is responsible for rebuilding its bufio.Reader on top of sc
+// before resuming reads.
+//
+// It holds sc's writeMu for the synthetic response write and the entire
+// handshake, both of which write to the pre-upgrade raw conn directly
+// (outside sc.Write): without the lock, the sibling direction's goroutine
+// could write a response through sc at the same time and interleave
+// plaintext bytes into the middle of the TLS handshake.
+func terminateStartTLS(sc *sharedConn, messageID int64) error {
+	if localTLSConfig == nil {
+		return fmt.Errorf("StartTLS termination requested but no local TLS certificate is configured")
+	}
+
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	raw := sc.current()
+	if _, err := raw.Write(synthesizeExtendedResponse(messageID)); err != nil {
+		return fmt.Errorf("writing StartTLS response: %w", err)
+	}
+
+	tlsConn := tls.Server(raw, localTLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake: %w", err)
+	}
+	sc.upgrade(tlsConn)
+	return nil
+}
+
+// synthesizeExtendedResponse builds the BER encoding of a successful
+// (resultCode=0), empty-OID ExtendedResponse for the given messageID.
+func synthesizeExtendedResponse(messageID int64) []byte {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "messageID"))
+
+	extResp := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(tagExtendedResponse), nil, "Extended Response")
+	extResp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(0), "resultCode: success"))
+	extResp.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	extResp.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	envelope.AppendChild(extResp)
+
+	return envelope.Bytes()
+}